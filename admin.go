@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// startAdminInterface serves the admin API - the set of endpoints that let
+// parts of a running Hoverfly be reconfigured without a restart - on
+// cfg.adminPort.
+func (d *DBClient) startAdminInterface() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/modifiers", d.ModifiersHandler)
+	mux.HandleFunc("/rules", d.RulesHandler)
+	mux.HandleFunc("/matcher", d.MatcherHandler)
+	mux.HandleFunc("/upstream-proxy", d.UpstreamProxyHandler)
+	mux.HandleFunc("/upstreams", d.UpstreamsHealthHandler)
+	mux.HandleFunc("/upstreams/drain", d.UpstreamsDrainHandler)
+
+	log.WithFields(log.Fields{
+		"AdminPort": d.cfg.adminPort,
+	}).Info("Admin interface starting")
+
+	log.Warn(http.ListenAndServe(fmt.Sprintf(":%s", d.cfg.adminPort), mux))
+}
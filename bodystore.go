@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// defaultMaxInlineBody is used when cfg.maxInlineBody is left unset.
+const defaultMaxInlineBody int64 = 1 << 20 // 1MB
+
+// BlobStore persists bodies too large to inline in a Payload to disk, content
+// addressed by sha256 so that identical bodies are only ever stored once.
+type BlobStore struct {
+	dir string
+}
+
+// NewBlobStore returns a BlobStore rooted at dir, creating it lazily on first
+// use rather than at construction time.
+func NewBlobStore(dir string) *BlobStore {
+	return &BlobStore{dir: dir}
+}
+
+func (b *BlobStore) path(ref string) string {
+	return filepath.Join(b.dir, ref)
+}
+
+// Put streams r to disk while hashing it, and returns the resulting
+// content-addressed reference. The body is written to a temp file first and
+// renamed into place so concurrent readers never see a partial blob.
+func (b *BlobStore) Put(r io.Reader) (string, error) {
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(b.dir, "blob-")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	ref := hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(tmp.Name(), b.path(ref)); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return ref, nil
+}
+
+// Open lazily opens the blob referenced by ref for reading, so replay does
+// not have to materialize the whole body in memory just to serve it.
+func (b *BlobStore) Open(ref string) (io.ReadCloser, error) {
+	return os.Open(b.path(ref))
+}
+
+// bodySummary describes how a body was persisted after passing it through
+// storeBody: either inlined, when small enough, or spilled to the blob store.
+type bodySummary struct {
+	Inline   []byte
+	BlobRef  string
+	Encoding string
+}
+
+// storeBody reads r, keeping it in memory as long as it stays within limit.
+// Once more than limit bytes have been read it spills everything read so far,
+// plus the remainder of r, into the blob store via a single streamed Put -
+// the body is never buffered twice and never decoded as a string, so large
+// or binary payloads are handled safely.
+func (d *DBClient) storeBody(r io.Reader, encoding string) (bodySummary, error) {
+	limit := d.cfg.maxInlineBody
+	if limit <= 0 {
+		limit = defaultMaxInlineBody
+	}
+
+	inline, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return bodySummary{}, err
+	}
+	if int64(len(inline)) <= limit {
+		return bodySummary{Inline: inline, Encoding: encoding}, nil
+	}
+
+	ref, err := d.blobs.Put(io.MultiReader(bytes.NewReader(inline), r))
+	if err != nil {
+		return bodySummary{}, err
+	}
+	return bodySummary{BlobRef: ref, Encoding: encoding}, nil
+}
+
+// requestBodySummary adapts a requestDetails' stored body back into a
+// bodySummary so it can be reopened with openBody.
+func requestBodySummary(r requestDetails) bodySummary {
+	return bodySummary{Inline: r.Body, BlobRef: r.BlobRef, Encoding: r.BodyEncoding}
+}
+
+// responseBodySummary is requestBodySummary's response-side counterpart.
+func responseBodySummary(r response) bodySummary {
+	return bodySummary{Inline: r.Body, BlobRef: r.BlobRef, Encoding: r.BodyEncoding}
+}
+
+// openBody reopens whatever storeBody produced as a single io.ReadCloser,
+// lazily reading the blob store only when the body actually spilled.
+func (d *DBClient) openBody(summary bodySummary) (io.ReadCloser, int64, error) {
+	if summary.BlobRef == "" {
+		return ioutil.NopCloser(bytes.NewReader(summary.Inline)), int64(len(summary.Inline)), nil
+	}
+	blob, err := d.blobs.Open(summary.BlobRef)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := os.Stat(d.blobs.path(summary.BlobRef))
+	if err != nil {
+		blob.Close()
+		return nil, 0, err
+	}
+	return blob, info.Size(), nil
+}
+
+// decodeBody decompresses body according to encoding ("gzip" or "deflate"),
+// so it is stored and forwarded compressed and only turned back into plain
+// bytes when something - a modifier, middleware - actually needs to read it.
+// Any other encoding (including "") is returned unchanged.
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case "deflate":
+		r := flate.NewReader(bytes.NewReader(body))
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return body, nil
+	}
+}
+
+// encodeBody is decodeBody's inverse: it re-compresses body under encoding so
+// it can be sent back out with the Content-Encoding it arrived with.
+func encodeBody(body []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "deflate":
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return body, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// extractBody captures resp.Body as a bodySummary - inlining it when it is
+// under cfg.maxInlineBody, spilling it to the blob store otherwise - then
+// restores resp.Body (from memory, or by lazily reopening the blob) so the
+// caller can still forward it to the client without reading it twice.
+func (d *DBClient) extractBody(resp *http.Response) (bodySummary, error) {
+	if resp.Body == nil {
+		return bodySummary{}, nil
+	}
+
+	body := resp.Body
+	defer body.Close()
+
+	summary, err := d.storeBody(body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return bodySummary{}, err
+	}
+
+	restored, size, err := d.openBody(summary)
+	if err != nil {
+		return bodySummary{}, err
+	}
+	resp.Body = restored
+	resp.ContentLength = size
+
+	return summary, nil
+}
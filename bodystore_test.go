@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// newTestDBClient returns a DBClient wired up with a scratch BlobStore,
+// suitable for exercising storeBody's inline/spill boundary.
+func newTestDBClient(t *testing.T, maxInlineBody int64) *DBClient {
+	dir, err := ioutil.TempDir("", "hoverfly-bodystore-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return &DBClient{
+		cfg:   &Configuration{maxInlineBody: maxInlineBody},
+		blobs: NewBlobStore(dir),
+	}
+}
+
+func TestStoreBodyInlineBoundary(t *testing.T) {
+	d := newTestDBClient(t, 4)
+
+	summary, err := d.storeBody(bytes.NewReader([]byte("abcd")), "")
+	if err != nil {
+		t.Fatalf("storeBody returned error: %v", err)
+	}
+	if summary.BlobRef != "" {
+		t.Fatalf("expected a body at the limit to stay inline, got BlobRef %q", summary.BlobRef)
+	}
+	if !bytes.Equal(summary.Inline, []byte("abcd")) {
+		t.Fatalf("expected inline body %q, got %q", "abcd", summary.Inline)
+	}
+}
+
+func TestStoreBodySpillsOverLimit(t *testing.T) {
+	d := newTestDBClient(t, 4)
+
+	summary, err := d.storeBody(bytes.NewReader([]byte("abcde")), "")
+	if err != nil {
+		t.Fatalf("storeBody returned error: %v", err)
+	}
+	if summary.BlobRef == "" {
+		t.Fatalf("expected a body over the limit to spill to the blob store")
+	}
+	if len(summary.Inline) != 0 {
+		t.Fatalf("expected no inline bytes once a body has spilled, got %q", summary.Inline)
+	}
+
+	body, size, err := d.openBody(summary)
+	if err != nil {
+		t.Fatalf("openBody returned error: %v", err)
+	}
+	defer body.Close()
+
+	got, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed to read reopened body: %v", err)
+	}
+	if size != int64(len(got)) || !bytes.Equal(got, []byte("abcde")) {
+		t.Fatalf("expected reopened body %q, got %q", "abcde", got)
+	}
+}
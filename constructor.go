@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Constructor turns a captured Payload back into the http.Request or
+// http.Response it describes. It holds a reference to the owning DBClient so
+// reconstruction can lazily open a body that spilled to the blob store,
+// rather than materializing it up front the way the inline bytes are.
+type Constructor struct {
+	db      *DBClient
+	request *http.Request
+	payload Payload
+}
+
+// NewConstructor returns a Constructor for request and payload, bound to db
+// so it can resolve any BlobRef the payload carries.
+func NewConstructor(db *DBClient, request *http.Request, payload Payload) *Constructor {
+	return &Constructor{db: db, request: request, payload: payload}
+}
+
+// ApplyMiddleware pipes c.payload as JSON through the named middleware binary
+// over stdin and replaces it with whatever JSON the binary writes to stdout.
+func (c *Constructor) ApplyMiddleware(middleware string) error {
+	bts, err := json.Marshal(c.payload)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(middleware)
+	cmd.Stdin = bytes.NewReader(bts)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	var payload Payload
+	if err := json.Unmarshal(out, &payload); err != nil {
+		return err
+	}
+	c.payload = payload
+	return nil
+}
+
+// reconstructRequest rebuilds the *http.Request to forward from
+// c.payload.Request, relative to the original c.request.
+func (c *Constructor) reconstructRequest() *http.Request {
+	body, size, err := c.db.openBody(requestBodySummary(c.payload.Request))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Failed to open stored request body")
+		body, size = ioutil.NopCloser(bytes.NewReader(nil)), 0
+	}
+
+	req := c.request
+	req.Body = body
+	req.ContentLength = size
+	req.Header = c.payload.Request.Headers
+	return req
+}
+
+// reconstructResponse rebuilds the *http.Response to return to the client
+// from c.payload.Response. Like reconstructRequest, it lazily opens the blob
+// store rather than reading a spilled body into memory, so replaying a large
+// capture is no more expensive than serving it the first time.
+func (c *Constructor) reconstructResponse() *http.Response {
+	body, size, err := c.db.openBody(responseBodySummary(c.payload.Response))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Failed to open stored response body")
+		body, size = ioutil.NopCloser(bytes.NewReader(nil)), 0
+	}
+
+	status := c.payload.Response.Status
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.payload.Response.Headers,
+		Body:          body,
+		ContentLength: size,
+		Request:       c.request,
+	}
+}
@@ -4,9 +4,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/elazarl/goproxy"
 
-	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -51,6 +51,14 @@ func main() {
 
 	endpoint := flag.String("endpoint", "", "forward all requests to this endpoint")
 
+	rulesFile := flag.String("rules-file", "", "YAML or JSON file of per-host routing rules (host_pattern, connect_action, mode_override, endpoint)")
+
+	upstreamProxy := flag.String("upstream-proxy", "", "forward outbound requests through this HTTP(S) proxy (e.g. for egress through a corporate proxy)")
+	upstreamProxyAuth := flag.String("upstream-proxy-auth", "", "basic auth credentials for -upstream-proxy, in user:password form")
+
+	maxInlineBody := flag.Int64("max-inline-body", defaultMaxInlineBody, "bodies larger than this many bytes are spilled to the blob store instead of stored inline")
+	blobStoreDir := flag.String("blob-store-dir", "blobs", "directory to spill bodies larger than -max-inline-body into")
+
 	// proxy port
 	proxyPort := flag.String("pp", "", "proxy port - run proxy on another port (i.e. '-pp 9999' to run proxy on port 9999)")
 	// admin port
@@ -79,6 +87,20 @@ func main() {
 		cfg.endpoint =*endpoint
 	}
 
+	if *rulesFile != "" {
+		rules, err := LoadRoutingRules(*rulesFile)
+		if err != nil {
+			log.Fatal("Failed to load -rules-file: " + err.Error())
+		}
+		cfg.rules = rules
+	}
+
+	cfg.upstreamProxy = *upstreamProxy
+	cfg.upstreamProxyAuth = *upstreamProxyAuth
+
+	cfg.maxInlineBody = *maxInlineBody
+	cfg.blobStoreDir = *blobStoreDir
+
 	// overriding default middleware setting
 	cfg.middleware = *middleware
 
@@ -137,48 +159,45 @@ func getNewHoverfly(cfg *Configuration) (*goproxy.ProxyHttpServer, DBClient) {
 		requestsBucket: []byte(requestsBucketName),
 	}
 
+	username, password := splitProxyAuth(cfg.upstreamProxyAuth)
+	upstreamProxy := &upstreamProxyState{
+		cfg: UpstreamProxyConfig{URL: cfg.upstreamProxy, Username: username, Password: password},
+	}
+
+	matcherConfigs := newMatcherConfigStore(cfg.matcherConfig)
+
 	// getting connections
 	d := DBClient{
-		cache: cache,
-		http:  &http.Client{},
-		cfg:   cfg,
+		cache:          cache,
+		http:           &http.Client{Transport: newUpstreamTransport(upstreamProxy)},
+		cfg:            cfg,
+		matcher:        NewMatcher(matcherConfigs),
+		matcherConfigs: matcherConfigs,
+		upstreamProxy:  upstreamProxy,
+		rules:          newRulesState(cfg.rules),
+		blobs:          NewBlobStore(cfg.blobStoreDir),
+	}
+
+	if len(cfg.upstreams) > 0 {
+		d.pool = NewUpstreamPool(cfg.upstreamPoolConfig, cfg.upstreams)
 	}
 
 	// creating proxy
 	proxy := goproxy.NewProxyHttpServer()
 
-	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(d.cfg.destination))).
-		HandleConnect(goproxy.AlwaysMitm)
-
-	// enable curl -p for all hosts on port 80
-	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(d.cfg.destination))).
-		HijackConnect(func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
-		defer func() {
-				log.Warn("Inside defer")
-			if e := recover(); e != nil {
-				ctx.Logf("error connecting to remote: %v", e)
-				client.Write([]byte("HTTP/1.1 500 Cannot reach destination\r\n\r\n"))
-			}
-			client.Close()
-		}()
-
-		log.Warn("Hijacking connection")
-		clientBuf := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
-		remote, err := net.Dial("tcp", req.URL.Host)
-		orPanic(err)
-		remoteBuf := bufio.NewReadWriter(bufio.NewReader(remote), bufio.NewWriter(remote))
-		for {
-			req, err := http.ReadRequest(clientBuf.Reader)
-			orPanic(err)
-			orPanic(req.Write(remoteBuf))
-			orPanic(remoteBuf.Flush())
-			resp, err := http.ReadResponse(remoteBuf.Reader, req)
-
-			orPanic(err)
-			orPanic(resp.Write(clientBuf.Writer))
-			orPanic(clientBuf.Flush())
-		}
-	})
+	if len(cfg.rules) > 0 {
+		registerRoutingRules(proxy, &d, cfg.rules)
+	} else {
+		proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(d.cfg.destination))).
+			HandleConnect(goproxy.AlwaysMitm)
+
+		// enable curl -p for all hosts on port 80
+		proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(d.cfg.destination))).
+			HijackConnect(func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+				hijackConnect(&d, req, client, ctx)
+			})
+	}
+
 	proxy.OnRequest().DoFunc(
 		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 			log.Warn("DoFunc")
@@ -199,18 +218,17 @@ func getNewHoverfly(cfg *Configuration) (*goproxy.ProxyHttpServer, DBClient) {
 		proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			log.Warn("NonproxyHandler")
 			req, resp := d.processRequest(r)
-			body, err := extractBody(resp)
-
-			if err != nil {
-					log.Error("Error reading response body")
-					w.WriteHeader(500)
-					return
+			if _, err := d.extractBody(resp); err != nil {
+				log.Error("Error reading response body")
+				w.WriteHeader(500)
+				return
 			}
+			defer resp.Body.Close()
 
 			w.Header().Set("X-stanislaw", "wozniak")
 			w.Header().Set("Req", req.RequestURI)
 			w.Header().Set("Resp", resp.Header.Get("Content-Length"))
-			w.Write(body)
+			io.Copy(w, resp.Body)
 		})
 	}
 
@@ -230,14 +248,37 @@ func getNewHoverfly(cfg *Configuration) (*goproxy.ProxyHttpServer, DBClient) {
 // processRequest - processes incoming requests and based on proxy state (record/playback)
 // returns HTTP response.
 func (d *DBClient) processRequest(req *http.Request) (*http.Request, *http.Response) {
-	req.Host = d.cfg.endpoint
-	req.URL.Host = d.cfg.endpoint
+	mode := d.cfg.GetMode()
+	endpoint := d.cfg.endpoint
+	selectedUpstream := ""
+
+	if rule := d.rules.get().Match(req.Host); rule != nil {
+		if rule.ModeOverride != "" {
+			mode = rule.ModeOverride
+		}
+		if rule.Endpoint != "" {
+			endpoint = rule.Endpoint
+		}
+	}
+
+	if d.pool != nil && (mode == CaptureMode || mode == ModifyMode) {
+		if upstream, ok := d.pool.Next(req); ok {
+			endpoint = upstream.Address
+			selectedUpstream = upstream.Address
+			upstream.Acquire()
+			defer upstream.Release()
+		} else {
+			log.Warn("No healthy upstream available")
+		}
+	}
+
+	req.Host = endpoint
+	req.URL.Host = endpoint
 	req.URL.Scheme = "http"
 
-	mode := d.cfg.GetMode()
 	if mode == CaptureMode {
 		log.Info("*** Capture ***")
-		newResponse, err := d.captureRequest(req)
+		newResponse, err := d.captureRequest(req, selectedUpstream)
 		if err != nil {
 			// something bad happened, passing through
 			return req, nil
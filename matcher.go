@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Supported values for MatcherConfig.Fallback.
+const (
+	FallbackExact               = "exact"
+	FallbackClosestByPathMethod = "closest-by-path+method"
+	FallbackTemplateMatch       = "template-match"
+)
+
+// Matcher computes the cache key used to store and look up a captured request.
+// It is the single place that decides which parts of a request are allowed to
+// vary between record and replay, replacing the previous hardcoded MD5 over
+// destination+path+method+query+body.
+type Matcher interface {
+	Key(req *http.Request, body []byte) string
+}
+
+// BodyNormalizer replaces every match of Pattern in the body with Replacement
+// before it contributes to the hash, so fields like a timestamp or nonce don't
+// split up what would otherwise be identical requests.
+type BodyNormalizer struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// MatcherConfig controls how defaultMatcher builds its key: which headers
+// participate, which query parameters are stripped beforehand, which body
+// normalizers run first, and what to try when the exact key misses. It is
+// admin-editable per destination host through MatcherHandler, and a copy of the
+// config in effect is stored in each captured Payload. Replay lookups, exact
+// and fallback alike, use the host's current config; the stored copy is not
+// read back.
+type MatcherConfig struct {
+	Headers          []string         `json:"headers,omitempty"`
+	StripQueryParams []string         `json:"strip_query_params,omitempty"`
+	BodyNormalizers  []BodyNormalizer `json:"body_normalizers,omitempty"`
+	Fallback         string           `json:"fallback,omitempty"`
+}
+
+// matcherConfigStore holds the default MatcherConfig plus per-destination
+// overrides, hot-swappable through MatcherHandler the same way routing rules
+// and the modifier chain are.
+type matcherConfigStore struct {
+	mu     sync.Mutex
+	def    MatcherConfig
+	byHost map[string]MatcherConfig
+}
+
+// newMatcherConfigStore returns a matcherConfigStore whose default is def,
+// with no per-host overrides yet.
+func newMatcherConfigStore(def MatcherConfig) *matcherConfigStore {
+	return &matcherConfigStore{def: def, byHost: map[string]MatcherConfig{}}
+}
+
+// configFor returns the MatcherConfig to use for host: its override if one has
+// been set, the store's default otherwise.
+func (s *matcherConfigStore) configFor(host string) MatcherConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cfg, ok := s.byHost[host]; ok {
+		return cfg
+	}
+	return s.def
+}
+
+// set stores cfg as the override for host, or as the new default when host is
+// empty.
+func (s *matcherConfigStore) set(host string, cfg MatcherConfig) {
+	s.mu.Lock()
+	if host == "" {
+		s.def = cfg
+	} else {
+		s.byHost[host] = cfg
+	}
+	s.mu.Unlock()
+}
+
+// defaultMatcher implements Matcher by looking up the MatcherConfig for the
+// request's destination host on every call, so per-destination overrides take
+// effect immediately.
+type defaultMatcher struct {
+	store *matcherConfigStore
+}
+
+// NewMatcher returns the default Matcher, backed by store.
+func NewMatcher(store *matcherConfigStore) Matcher {
+	return &defaultMatcher{store: store}
+}
+
+// normalizeBody applies every BodyNormalizer configured in cfg, in order.
+func normalizeBody(cfg MatcherConfig, body []byte) []byte {
+	for _, n := range cfg.BodyNormalizers {
+		re, err := regexp.Compile(n.Pattern)
+		if err != nil {
+			continue
+		}
+		body = re.ReplaceAll(body, []byte(n.Replacement))
+	}
+	return body
+}
+
+// filterQueryString strips cfg.StripQueryParams from rawQuery.
+func filterQueryString(cfg MatcherConfig, rawQuery string) string {
+	if len(cfg.StripQueryParams) == 0 {
+		return rawQuery
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	for _, p := range cfg.StripQueryParams {
+		values.Del(p)
+	}
+	return values.Encode()
+}
+
+// filteredQuery returns req's query string with cfg.StripQueryParams removed.
+func filteredQuery(cfg MatcherConfig, req *http.Request) string {
+	return filterQueryString(cfg, req.URL.RawQuery)
+}
+
+// Key builds the MD5 hash used as the cache key, over destination, path,
+// method, the filtered query, the normalized body and any configured headers.
+func (m *defaultMatcher) Key(req *http.Request, body []byte) string {
+	cfg := m.store.configFor(req.Host)
+
+	var buffer bytes.Buffer
+	buffer.WriteString(req.Host)
+	buffer.WriteString(req.URL.Path)
+	buffer.WriteString(req.Method)
+	buffer.WriteString(filteredQuery(cfg, req))
+	buffer.Write(normalizeBody(cfg, body))
+
+	for _, name := range cfg.Headers {
+		buffer.WriteString(name)
+		buffer.WriteString(req.Header.Get(name))
+	}
+
+	h := md5.New()
+	h.Write(buffer.Bytes())
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// MatcherHandler handles `GET /matcher` and `POST /matcher`, viewing and
+// setting the MatcherConfig for a destination host. GET takes an optional
+// `host` query parameter and returns that host's override, or the default
+// config when host is omitted or has no override. POST takes
+// `{"host": "...", "config": {...}}`; an empty host replaces the default.
+func (d *DBClient) MatcherHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		cfg := d.matcherConfigs.configFor(req.URL.Query().Get("host"))
+		bts, err := json.Marshal(cfg)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("Failed to serialize matcher config")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(bts)
+
+	case http.MethodPost:
+		var body struct {
+			Host   string        `json:"host"`
+			Config MatcherConfig `json:"config"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		d.matcherConfigs.set(body.Host, body.Config)
+		log.WithFields(log.Fields{
+			"host": body.Host,
+		}).Info("Matcher config updated")
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// findClosestMatch falls through to a secondary lookup when the exact key
+// misses, picking the strategy named by the matching destination's
+// MatcherConfig.Fallback.
+func (d *DBClient) findClosestMatch(req *http.Request, body []byte) (*Payload, bool) {
+	cfg := d.matcherConfigs.configFor(req.Host)
+	switch cfg.Fallback {
+	case FallbackClosestByPathMethod:
+		return d.findClosestMatchByPathMethod(cfg, req, body)
+	case FallbackTemplateMatch:
+		return d.findClosestMatchByTemplate(cfg, req, body)
+	default:
+		return nil, false
+	}
+}
+
+// findClosestMatchByPathMethod indexes candidates on the exact
+// (host, method, path) triple, picking the one whose remaining fields (query,
+// body, headers) score highest against req under cfg's normalization.
+func (d *DBClient) findClosestMatchByPathMethod(cfg MatcherConfig, req *http.Request, body []byte) (*Payload, bool) {
+	return bestCandidate(d, cfg, req, body, func(candidate requestDetails, req *http.Request) bool {
+		return candidate.Destination == req.Host &&
+			candidate.Method == req.Method &&
+			candidate.Path == req.URL.Path
+	})
+}
+
+// idSegment matches a purely-numeric or UUID/hex-like path segment, the kind
+// of thing templateOf wildcards out so e.g. /users/42/orders and
+// /users/7/orders are treated as the same route.
+var idSegment = regexp.MustCompile(`^[0-9]+$|^[0-9a-fA-F]{8}-[0-9a-fA-F-]{4,}$`)
+
+// templateOf reduces path to a template by replacing id-shaped segments with
+// a fixed placeholder.
+func templateOf(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if idSegment.MatchString(s) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// findClosestMatchByTemplate indexes candidates on (host, method, path
+// template) instead of the literal path, so a request against a route whose
+// path embeds an id that changed between capture and replay - e.g.
+// /users/42/orders captured, /users/7/orders replayed - can still be matched.
+func (d *DBClient) findClosestMatchByTemplate(cfg MatcherConfig, req *http.Request, body []byte) (*Payload, bool) {
+	reqTemplate := templateOf(req.URL.Path)
+	return bestCandidate(d, cfg, req, body, func(candidate requestDetails, req *http.Request) bool {
+		return candidate.Destination == req.Host &&
+			candidate.Method == req.Method &&
+			templateOf(candidate.Path) == reqTemplate
+	})
+}
+
+// bestCandidate scans every cached payload, keeping the one that satisfies
+// eligible and scores highest against req via scoreCandidate, using cfg's
+// normalization so candidates are compared on the same terms Key() hashed
+// them on.
+func bestCandidate(d *DBClient, cfg MatcherConfig, req *http.Request, body []byte, eligible func(requestDetails, *http.Request) bool) (*Payload, bool) {
+	candidates, err := d.cache.GetAllValues()
+	if err != nil {
+		return nil, false
+	}
+
+	var best *Payload
+	bestScore := -1
+	for _, raw := range candidates {
+		payload, err := decodePayload(raw)
+		if err != nil {
+			continue
+		}
+		if !eligible(payload.Request, req) {
+			continue
+		}
+		if score := scoreCandidate(cfg, payload.Request, req, body); score > bestScore {
+			bestScore = score
+			best = payload
+		}
+	}
+
+	return best, best != nil
+}
+
+// scoreCandidate counts how many of query, body and headers a cached request
+// shares with req, used to rank candidates sharing the same host/method/path
+// (or path template). Query and body are compared after cfg's normalization,
+// and only headers listed in cfg.Headers are considered, mirroring Key() so
+// the fallback can't be defeated by fields Key() itself ignores.
+func scoreCandidate(cfg MatcherConfig, candidate requestDetails, req *http.Request, body []byte) int {
+	score := 0
+	if filterQueryString(cfg, candidate.Query) == filteredQuery(cfg, req) {
+		score++
+	}
+	if bytes.Equal(normalizeBody(cfg, candidate.Body), normalizeBody(cfg, body)) {
+		score++
+	}
+	for _, name := range cfg.Headers {
+		values, ok := candidate.Headers[name]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if values[0] == req.Header.Get(name) {
+			score++
+		}
+	}
+	return score
+}
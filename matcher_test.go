@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newGetRequest(host, path string) *http.Request {
+	return &http.Request{
+		Host:   host,
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: path},
+		Header: http.Header{},
+	}
+}
+
+func TestMatcherConfigStorePerDestination(t *testing.T) {
+	store := newMatcherConfigStore(MatcherConfig{Fallback: FallbackExact})
+	store.set("api.example.com", MatcherConfig{Fallback: FallbackClosestByPathMethod})
+
+	if got := store.configFor("api.example.com").Fallback; got != FallbackClosestByPathMethod {
+		t.Fatalf("expected override for api.example.com, got %q", got)
+	}
+	if got := store.configFor("other.example.com").Fallback; got != FallbackExact {
+		t.Fatalf("expected hosts with no override to fall back to the default, got %q", got)
+	}
+}
+
+func TestMatcherConfigStoreSetDefault(t *testing.T) {
+	store := newMatcherConfigStore(MatcherConfig{Fallback: FallbackExact})
+	store.set("", MatcherConfig{Fallback: FallbackTemplateMatch})
+
+	if got := store.configFor("anything"); got.Fallback != FallbackTemplateMatch {
+		t.Fatalf("expected an empty host to replace the default, got %q", got.Fallback)
+	}
+}
+
+func TestMatcherKeyStableForEquivalentRequests(t *testing.T) {
+	store := newMatcherConfigStore(MatcherConfig{StripQueryParams: []string{"nonce"}})
+	m := NewMatcher(store)
+
+	req1 := newGetRequest("api.example.com", "/widgets")
+	req1.URL.RawQuery = "nonce=1"
+	req2 := newGetRequest("api.example.com", "/widgets")
+	req2.URL.RawQuery = "nonce=2"
+
+	if m.Key(req1, []byte("body")) != m.Key(req2, []byte("body")) {
+		t.Fatalf("expected requests differing only in a stripped query param to hash to the same key")
+	}
+}
+
+func TestScoreCandidateIgnoresStrippedQueryParam(t *testing.T) {
+	cfg := MatcherConfig{StripQueryParams: []string{"nonce"}}
+
+	req := newGetRequest("api.example.com", "/widgets")
+	req.URL.RawQuery = "nonce=1"
+	candidate := requestDetails{Query: "nonce=2", Headers: map[string][]string{}}
+
+	// the stripped queries match, and so do the two empty bodies
+	if score := scoreCandidate(cfg, candidate, req, nil); score != 2 {
+		t.Fatalf("expected the stripped query param to still score a match, got %d", score)
+	}
+}
+
+func TestScoreCandidateIgnoresHeadersNotWhitelisted(t *testing.T) {
+	cfg := MatcherConfig{Headers: []string{"X-Tracked"}}
+
+	req := newGetRequest("api.example.com", "/widgets")
+	req.Header.Set("X-Tracked", "a")
+	req.Header.Set("X-Ignored", "a")
+	candidate := requestDetails{
+		Headers: map[string][]string{
+			"X-Tracked": {"a"},
+			"X-Ignored": {"b"},
+		},
+	}
+
+	// empty query, empty body and X-Tracked match; X-Ignored is not compared
+	if score := scoreCandidate(cfg, candidate, req, nil); score != 3 {
+		t.Fatalf("expected only the whitelisted header to contribute to the score, got %d", score)
+	}
+}
+
+func TestScoreCandidateNormalizesBody(t *testing.T) {
+	cfg := MatcherConfig{BodyNormalizers: []BodyNormalizer{{Pattern: `"ts":[0-9]+`, Replacement: `"ts":0`}}}
+
+	req := newGetRequest("api.example.com", "/widgets")
+	candidate := requestDetails{
+		Body:    []byte(`{"ts":111}`),
+		Headers: map[string][]string{},
+	}
+
+	// the empty queries match, and so do the normalized bodies
+	if score := scoreCandidate(cfg, candidate, req, []byte(`{"ts":222}`)); score != 2 {
+		t.Fatalf("expected bodies differing only in a normalized field to score a match, got %d", score)
+	}
+}
+
+func TestTemplateOfWildcardsIDSegments(t *testing.T) {
+	cases := map[string]string{
+		"/users/42/orders": "/users/:id/orders",
+		"/users/abcd1234-ab12-4cde-8f90-1234567890ab": "/users/:id",
+		"/widgets": "/widgets",
+	}
+	for path, want := range cases {
+		if got := templateOf(path); got != want {
+			t.Errorf("templateOf(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
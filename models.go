@@ -2,11 +2,9 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/gob"
-	"fmt"
-	"io"
 	"net/http"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/elazarl/goproxy"
@@ -15,14 +13,35 @@ import (
 
 // DBClient provides access to cache, http client and configuration
 type DBClient struct {
-	cache Cache
-	http  *http.Client
-	cfg   *Configuration
-}
-
-// request holds structure for request
-type request struct {
-	details requestDetails
+	cache   Cache
+	http    *http.Client
+	cfg     *Configuration
+	matcher Matcher
+
+	// matcherConfigs is the live, per-destination-host MatcherConfig store that
+	// backs matcher; it is what MatcherHandler edits at runtime.
+	matcherConfigs *matcherConfigStore
+
+	// modifier is the in-process chain configured through POST /modifiers; when
+	// no binary middleware is set, doRequest, getResponse and
+	// modifyRequestResponse apply it in its place.
+	modifier   Modifier
+	modifierMu sync.Mutex
+
+	// rules is the live per-host routing rule list, hot-swappable through
+	// RulesHandler; processRequest consults it instead of cfg.rules directly.
+	rules *rulesState
+
+	// upstreamProxy holds the live upstream HTTP(S) egress proxy configuration,
+	// hot-swappable through UpstreamProxyHandler.
+	upstreamProxy *upstreamProxyState
+
+	// pool is the load-balanced set of forwarding destinations used in place of
+	// cfg.endpoint in capture and modify modes when Upstreams are configured.
+	pool *UpstreamPool
+
+	// blobs is where bodies larger than cfg.maxInlineBody spill to on capture.
+	blobs *BlobStore
 }
 
 var emptyResp = &http.Response{}
@@ -34,37 +53,34 @@ type requestDetails struct {
 	Destination string              `json:"destination"`
 	Scheme      string              `json:"scheme"`
 	Query       string              `json:"query"`
-	Body        string              `json:"body"`
-	RemoteAddr  string              `json:"remoteAddr"`
-	Headers     map[string][]string `json:"headers"`
-}
-
-func (r *request) concatenate() string {
-	var buffer bytes.Buffer
-
-	buffer.WriteString(r.details.Destination)
-	buffer.WriteString(r.details.Path)
-	buffer.WriteString(r.details.Method)
-	buffer.WriteString(r.details.Query)
-	buffer.WriteString(r.details.Body)
-
-	return buffer.String()
-}
-
-// hash returns unique hash key for request
-func (r *request) hash() string {
-	h := md5.New()
-	io.WriteString(h, r.concatenate())
-	return fmt.Sprintf("%x", h.Sum(nil))
+	// Body holds the request body verbatim as bytes, not a string, so binary
+	// payloads survive a round trip; it is nil when BlobRef is set instead.
+	Body []byte `json:"body,omitempty"`
+	// BlobRef, when set, points at the body in the blob store instead of Body,
+	// because it was larger than cfg.maxInlineBody at capture time.
+	BlobRef string `json:"blobRef,omitempty"`
+	// BodyEncoding mirrors the request's Content-Encoding header so a stored
+	// body can be identified as compressed without re-reading the headers.
+	BodyEncoding string              `json:"bodyEncoding,omitempty"`
+	RemoteAddr   string              `json:"remoteAddr"`
+	Headers      map[string][]string `json:"headers"`
 }
 
 // res structure hold response body from external service, body is not decoded and is supposed
 // to be bytes, however headers should provide all required information for later decoding
 // by the client.
 type response struct {
-	Status  int                 `json:"status"`
-	Body    string              `json:"body"`
-	Headers map[string][]string `json:"headers"`
+	Status int `json:"status"`
+	// Body holds the response body verbatim as bytes; nil when BlobRef is set instead.
+	Body []byte `json:"body,omitempty"`
+	// BlobRef, when set, points at the body in the blob store instead of Body,
+	// because it was larger than cfg.maxInlineBody at capture time.
+	BlobRef      string              `json:"blobRef,omitempty"`
+	BodyEncoding string              `json:"bodyEncoding,omitempty"`
+	Headers      map[string][]string `json:"headers"`
+	// Upstream records which pool member served this response, so a capture
+	// session against a pool is still reproducible on replay.
+	Upstream string `json:"upstream,omitempty"`
 }
 
 // Payload structure holds request and response structure
@@ -72,6 +88,9 @@ type Payload struct {
 	Response response       `json:"response"`
 	Request  requestDetails `json:"request"`
 	ID       string         `json:"id"`
+	// Matcher is the MatcherConfig active when this payload was captured. It is
+	// stored only: lookups on replay use the host's current config, not this copy.
+	Matcher MatcherConfig `json:"matcher,omitempty"`
 }
 
 // encode method encodes all exported Payload fields to bytes
@@ -97,79 +116,62 @@ func decodePayload(data []byte) (*Payload, error) {
 	return p, nil
 }
 
-// recordRequest saves request for later playback
-func (d *DBClient) captureRequest(req *http.Request) (*http.Response, error) {
+// captureRequest saves request for later playback. upstream is the pool
+// member processRequest selected to serve it, if any, so save() can record
+// which upstream a capture session against a pool actually hit - it is passed
+// straight through rather than smuggled via a request header, so it can never
+// leak onto the wire.
+func (d *DBClient) captureRequest(req *http.Request, upstream string) (*http.Response, error) {
 
 	// this is mainly for testing, since when you create
 	if req.Body == nil {
 		req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte("")))
 	}
 
-	reqBody, err := ioutil.ReadAll(req.Body)
+	// Read the whole body up front so the matcher key can be computed over the
+	// real content; storeBody is still what decides whether it ends up inline
+	// or spilled to the blob store.
+	rawBody, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Error("Got error when reading request body")
 	}
-	log.WithFields(log.Fields{
-		"body": string(reqBody),
-	}).Info("got request body")
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(reqBody))
+
+	// Run the modifier chain, if any, against a throwaway copy of the body
+	// before it is persisted, so e.g. a body.Replace modifier can scrub a
+	// secret out of what ends up in the cache. The real, unscrubbed rawBody
+	// below is what is handed to doRequest, which runs the modifier chain on
+	// the outgoing request in its own right.
+	reqSummary, err := d.storeBody(bytes.NewReader(d.scrubRequestBody(req, rawBody)), req.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(rawBody))
+	req.ContentLength = int64(len(rawBody))
 
 	// forwarding request
 	resp, err := d.doRequest(req)
 
 	if err == nil {
-		respBody, err := extractBody(resp)
+		respSummary, err := d.extractBody(resp)
 		if err != nil {
-			// copying the response body did not work
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err.Error(),
-				}).Error("Failed to copy response body.")
-			}
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("Failed to capture response body.")
 		}
 
 		// saving response body with request/response meta to cache
-		d.save(req, reqBody, resp, respBody)
+		d.save(req, reqSummary, rawBody, resp, respSummary, upstream)
 	}
 
 	// return new response or error here
 	return resp, err
 }
 
-func copyBody(body io.ReadCloser) (resp1, resp2 io.ReadCloser, err error) {
-	var buf bytes.Buffer
-	if _, err = buf.ReadFrom(body); err != nil {
-		return nil, nil, err
-	}
-	if err = body.Close(); err != nil {
-		return nil, nil, err
-	}
-	return ioutil.NopCloser(&buf), ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
-}
-
-func extractBody(resp *http.Response) (extract []byte, err error) {
-	save := resp.Body
-	savecl := resp.ContentLength
-
-	save, resp.Body, err = copyBody(resp.Body)
-
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-	extract, err = ioutil.ReadAll(resp.Body)
-
-	resp.Body = save
-	resp.ContentLength = savecl
-	if err != nil {
-		return nil, err
-	}
-	return extract, nil
-}
-
 // doRequest performs original request and returns response that should be returned to client and error (if there is one)
 func (d *DBClient) doRequest(request *http.Request) (*http.Response, error) {
 	// We can't have this set. And it only contains "/pkg/net/http/" anyway
@@ -178,15 +180,21 @@ func (d *DBClient) doRequest(request *http.Request) (*http.Response, error) {
 	if d.cfg.middleware != "" {
 		var payload Payload
 
-		c := NewConstructor(request, payload)
+		c := NewConstructor(d, request, payload)
 		c.ApplyMiddleware(d.cfg.middleware)
 
 		request = c.reconstructRequest()
 
+	} else if err := d.applyModifiersToRequest(request); err != nil {
+		return nil, err
 	}
 
 	resp, err := d.http.Do(request)
 
+	if d.pool != nil {
+		d.pool.RecordResult(request.Host, err != nil || (resp != nil && resp.StatusCode >= http.StatusInternalServerError))
+	}
+
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error":  err.Error(),
@@ -197,6 +205,15 @@ func (d *DBClient) doRequest(request *http.Request) (*http.Response, error) {
 		return nil, err
 	}
 
+	if d.cfg.middleware == "" {
+		if err := d.applyModifiersToResponse(resp); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("Modifier chain rejected response")
+			return nil, err
+		}
+	}
+
 	log.WithFields(log.Fields{
 		"host":   request.Host,
 		"method": request.Method,
@@ -208,44 +225,54 @@ func (d *DBClient) doRequest(request *http.Request) (*http.Response, error) {
 
 }
 
-// save gets request fingerprint, extracts request body, status code and headers, then saves it to cache
-func (d *DBClient) save(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+// save computes the request's matcher key, then saves the captured request/response
+// summaries, status code and headers to cache. Bodies that spilled to the blob
+// store are saved as a BlobRef rather than inline, matching how they were
+// captured. reqBody is the real, pre-spill request body - not reqSummary.Inline,
+// which is empty once a body has spilled - so the key matches what getResponse
+// computes from the replayed request's body on lookup.
+func (d *DBClient) save(req *http.Request, reqSummary bodySummary, reqBody []byte, resp *http.Response, respSummary bodySummary, upstream string) {
 	// record request here
-	key := getRequestFingerprint(req, reqBody)
+	key := d.matcher.Key(req, reqBody)
 
 	if resp == nil {
 		resp = emptyResp
 	} else {
 		responseObj := response{
-			Status:  resp.StatusCode,
-			Body:    string(respBody),
-			Headers: resp.Header,
+			Status:       resp.StatusCode,
+			Body:         respSummary.Inline,
+			BlobRef:      respSummary.BlobRef,
+			BodyEncoding: respSummary.Encoding,
+			Headers:      resp.Header,
+			Upstream:     upstream,
 		}
 
 		log.WithFields(log.Fields{
 			"path":          req.URL.Path,
 			"rawQuery":      req.URL.RawQuery,
 			"requestMethod": req.Method,
-			"bodyLen":       len(reqBody),
 			"destination":   req.Host,
 			"hashKey":       key,
 		}).Info("Capturing")
 
 		requestObj := requestDetails{
-			Path:        req.URL.Path,
-			Method:      req.Method,
-			Destination: req.Host,
-			Scheme:      req.URL.Scheme,
-			Query:       req.URL.RawQuery,
-			Body:        string(reqBody),
-			RemoteAddr:  req.RemoteAddr,
-			Headers:     req.Header,
+			Path:         req.URL.Path,
+			Method:       req.Method,
+			Destination:  req.Host,
+			Scheme:       req.URL.Scheme,
+			Query:        req.URL.RawQuery,
+			Body:         reqSummary.Inline,
+			BlobRef:      reqSummary.BlobRef,
+			BodyEncoding: reqSummary.Encoding,
+			RemoteAddr:   req.RemoteAddr,
+			Headers:      req.Header,
 		}
 
 		payload := Payload{
 			Response: responseObj,
 			Request:  requestObj,
 			ID:       key,
+			Matcher:  d.matcherConfigs.configFor(req.Host),
 		}
 
 		bts, err := payload.encode()
@@ -259,20 +286,6 @@ func (d *DBClient) save(req *http.Request, reqBody []byte, resp *http.Response,
 	}
 }
 
-// getRequestFingerprint returns request hash
-func getRequestFingerprint(req *http.Request, requestBody []byte) string {
-	details := requestDetails{
-		Path:        req.URL.Path,
-		Method:      req.Method,
-		Destination: req.Host,
-		Query:       req.URL.RawQuery,
-		Body:        string(requestBody),
-	}
-
-	r := request{details: details}
-	return r.hash()
-}
-
 // getResponse returns stored response from cache
 func (d *DBClient) getResponse(req *http.Request) *http.Response {
 
@@ -284,7 +297,7 @@ func (d *DBClient) getResponse(req *http.Request) *http.Response {
 		}).Error("Got error when reading request body")
 	}
 
-	key := getRequestFingerprint(req, reqBody)
+	key := d.matcher.Key(req, reqBody)
 
 	payloadBts, err := d.cache.Get([]byte(key))
 
@@ -298,7 +311,7 @@ func (d *DBClient) getResponse(req *http.Request) *http.Response {
 			return nil
 		}
 
-		c := NewConstructor(req, *payload)
+		c := NewConstructor(d, req, *payload)
 
 		if d.cfg.middleware != "" {
 			_ = c.ApplyMiddleware(d.cfg.middleware)
@@ -306,6 +319,14 @@ func (d *DBClient) getResponse(req *http.Request) *http.Response {
 
 		response := c.reconstructResponse()
 
+		if d.cfg.middleware == "" {
+			if err := d.applyModifiersToResponse(response); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Error("Modifier chain rejected cached response")
+			}
+		}
+
 		log.WithFields(log.Fields{
 			"key":        key,
 			"status":     payload.Response.Status,
@@ -316,6 +337,21 @@ func (d *DBClient) getResponse(req *http.Request) *http.Response {
 
 	}
 
+	if payload, ok := d.findClosestMatch(req, reqBody); ok {
+		c := NewConstructor(d, req, *payload)
+		if d.cfg.middleware != "" {
+			_ = c.ApplyMiddleware(d.cfg.middleware)
+		}
+		response := c.reconstructResponse()
+
+		log.WithFields(log.Fields{
+			"key":    key,
+			"status": payload.Response.Status,
+		}).Info("Exact match missed, returning closest match")
+
+		return response
+	}
+
 	log.WithFields(log.Fields{
 		"error":       err.Error(),
 		"query":       req.URL.RawQuery,
@@ -342,7 +378,7 @@ func (d *DBClient) modifyRequestResponse(req *http.Request, middleware string) (
 	}
 
 	// preparing payload
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	summary, err := d.extractBody(resp)
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -353,22 +389,31 @@ func (d *DBClient) modifyRequestResponse(req *http.Request, middleware string) (
 	}
 
 	r := response{
-		Status:  resp.StatusCode,
-		Body:    string(bodyBytes),
-		Headers: resp.Header,
+		Status:       resp.StatusCode,
+		Body:         summary.Inline,
+		BlobRef:      summary.BlobRef,
+		BodyEncoding: summary.Encoding,
+		Headers:      resp.Header,
 	}
 	payload := Payload{Response: r}
 
-	c := NewConstructor(req, payload)
-	// applying middleware to modify response
-	err = c.ApplyMiddleware(middleware)
+	c := NewConstructor(d, req, payload)
 
-	if err != nil {
-		return nil, err
+	if middleware != "" {
+		// applying middleware to modify response
+		if err = c.ApplyMiddleware(middleware); err != nil {
+			return nil, err
+		}
 	}
 
 	newResponse := c.reconstructResponse()
 
+	if middleware == "" {
+		if err := d.applyModifiersToResponse(newResponse); err != nil {
+			return nil, err
+		}
+	}
+
 	log.WithFields(log.Fields{
 		"status":     newResponse.StatusCode,
 		"middleware": middleware,
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Modifier is an in-process alternative to a binary middleware: it is given the
+// chance to mutate a request before it is forwarded and a response before it is
+// returned to the client.
+type Modifier interface {
+	ModifyRequest(*http.Request) error
+	ModifyResponse(*http.Response) error
+}
+
+// modifierFactory builds a Modifier from the JSON body of a single node.
+type modifierFactory func(json.RawMessage) (Modifier, error)
+
+// modifierRegistry maps a node's type key, e.g. "header.Modifier", to the factory
+// that knows how to parse it. New modifier types are added to this map.
+var modifierRegistry = map[string]modifierFactory{
+	"header.Modifier": newHeaderModifier,
+	"body.Replace":    newBodyReplaceModifier,
+	"status.Modifier": newStatusModifier,
+	"url.Filter":      newURLFilterModifier,
+	"group.Modifier":  newGroupModifier,
+	"filter.Modifier": newFilterModifier,
+}
+
+// parseModifier decodes a single `{"type.Name": {...}}` document using modifierRegistry.
+func parseModifier(raw json.RawMessage) (Modifier, error) {
+	var node map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &node); err != nil {
+		return nil, err
+	}
+	if len(node) != 1 {
+		return nil, fmt.Errorf("modifier node should have exactly one key, got %d", len(node))
+	}
+	for name, body := range node {
+		factory, ok := modifierRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown modifier type %q", name)
+		}
+		return factory(body)
+	}
+	return nil, fmt.Errorf("empty modifier node")
+}
+
+// parseModifiers decodes a JSON array of modifier nodes in order.
+func parseModifiers(raw []json.RawMessage) ([]Modifier, error) {
+	modifiers := make([]Modifier, 0, len(raw))
+	for _, node := range raw {
+		m, err := parseModifier(node)
+		if err != nil {
+			return nil, err
+		}
+		modifiers = append(modifiers, m)
+	}
+	return modifiers, nil
+}
+
+// headerModifier sets a single header on the request and/or response.
+type headerModifier struct {
+	Scope []string `json:"scope"`
+	Name  string   `json:"name"`
+	Value string   `json:"value"`
+}
+
+func newHeaderModifier(raw json.RawMessage) (Modifier, error) {
+	m := &headerModifier{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *headerModifier) appliesTo(scope string) bool {
+	if len(m.Scope) == 0 {
+		return true
+	}
+	for _, s := range m.Scope {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *headerModifier) ModifyRequest(req *http.Request) error {
+	if m.appliesTo("request") {
+		req.Header.Set(m.Name, m.Value)
+	}
+	return nil
+}
+
+func (m *headerModifier) ModifyResponse(resp *http.Response) error {
+	if m.appliesTo("response") {
+		resp.Header.Set(m.Name, m.Value)
+	}
+	return nil
+}
+
+// bodyReplaceModifier rewrites a request or response body by replacing every
+// match of Pattern with Replacement - on the request side this is what lets
+// captureRequest scrub a secret out of the body before it is persisted to
+// cache, and on the response side it can rewrite or fake a payload before it
+// reaches the client.
+type bodyReplaceModifier struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	re          *regexp.Regexp
+}
+
+func newBodyReplaceModifier(raw json.RawMessage) (Modifier, error) {
+	m := &bodyReplaceModifier{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(m.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	m.re = re
+	return m, nil
+}
+
+func (m *bodyReplaceModifier) ModifyRequest(req *http.Request) error {
+	if req.Body == nil {
+		return nil
+	}
+	raw, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body.Close()
+
+	encoding := req.Header.Get("Content-Encoding")
+	body, err := decodeBody(raw, encoding)
+	if err != nil {
+		return err
+	}
+
+	body = m.re.ReplaceAll(body, []byte(m.Replacement))
+
+	body, err = encodeBody(body, encoding)
+	if err != nil {
+		return err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	return nil
+}
+
+func (m *bodyReplaceModifier) ModifyResponse(resp *http.Response) error {
+	if resp.Body == nil {
+		return nil
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	encoding := resp.Header.Get("Content-Encoding")
+	body, err := decodeBody(raw, encoding)
+	if err != nil {
+		return err
+	}
+
+	body = m.re.ReplaceAll(body, []byte(m.Replacement))
+
+	body, err = encodeBody(body, encoding)
+	if err != nil {
+		return err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	return nil
+}
+
+// statusModifier forces the response status code.
+type statusModifier struct {
+	Code int `json:"code"`
+}
+
+func newStatusModifier(raw json.RawMessage) (Modifier, error) {
+	m := &statusModifier{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *statusModifier) ModifyRequest(req *http.Request) error { return nil }
+
+func (m *statusModifier) ModifyResponse(resp *http.Response) error {
+	resp.StatusCode = m.Code
+	resp.Status = fmt.Sprintf("%d %s", m.Code, http.StatusText(m.Code))
+	return nil
+}
+
+// urlFilterModifier rejects requests whose host does not match Host.
+type urlFilterModifier struct {
+	Host string `json:"host"`
+	re   *regexp.Regexp
+}
+
+func newURLFilterModifier(raw json.RawMessage) (Modifier, error) {
+	m := &urlFilterModifier{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(m.Host)
+	if err != nil {
+		return nil, err
+	}
+	m.re = re
+	return m, nil
+}
+
+func (m *urlFilterModifier) matches(req *http.Request) bool {
+	return m.re.MatchString(req.Host)
+}
+
+func (m *urlFilterModifier) ModifyRequest(req *http.Request) error {
+	if !m.matches(req) {
+		return fmt.Errorf("url.Filter: host %q does not match %q", req.Host, m.Host)
+	}
+	return nil
+}
+
+func (m *urlFilterModifier) ModifyResponse(resp *http.Response) error { return nil }
+
+// groupModifier runs its children in order, stopping at the first error.
+type groupModifier struct {
+	Children []json.RawMessage `json:"children"`
+	children []Modifier
+}
+
+func newGroupModifier(raw json.RawMessage) (Modifier, error) {
+	m := &groupModifier{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	children, err := parseModifiers(m.Children)
+	if err != nil {
+		return nil, err
+	}
+	m.children = children
+	return m, nil
+}
+
+func (m *groupModifier) ModifyRequest(req *http.Request) error {
+	for _, child := range m.children {
+		if err := child.ModifyRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *groupModifier) ModifyResponse(resp *http.Response) error {
+	for _, child := range m.children {
+		if err := child.ModifyResponse(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterModifier runs ChildOnMatch when Match's request check passes, ChildOnNoMatch
+// otherwise. A single parsed chain is shared (via d.modifier) across every
+// concurrent request, so the match decision can't be cached on the instance
+// between ModifyRequest and ModifyResponse without one request's result
+// racing another's; ModifyResponse instead recomputes it from resp.Request.
+type filterModifier struct {
+	Match          json.RawMessage   `json:"match"`
+	ChildOnMatch   []json.RawMessage `json:"child_on_match"`
+	ChildOnNoMatch []json.RawMessage `json:"child_on_no_match"`
+	match          *urlFilterModifier
+	onMatch        []Modifier
+	onNoMatch      []Modifier
+}
+
+func newFilterModifier(raw json.RawMessage) (Modifier, error) {
+	m := &filterModifier{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+
+	match, err := newURLFilterModifier(m.Match)
+	if err != nil {
+		return nil, err
+	}
+	m.match = match.(*urlFilterModifier)
+
+	if m.onMatch, err = parseModifiers(m.ChildOnMatch); err != nil {
+		return nil, err
+	}
+	if m.onNoMatch, err = parseModifiers(m.ChildOnNoMatch); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *filterModifier) ModifyRequest(req *http.Request) error {
+	children := m.onNoMatch
+	if m.match.matches(req) {
+		children = m.onMatch
+	}
+	for _, child := range children {
+		if err := child.ModifyRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *filterModifier) ModifyResponse(resp *http.Response) error {
+	matched := resp.Request != nil && m.match.matches(resp.Request)
+
+	children := m.onNoMatch
+	if matched {
+		children = m.onMatch
+	}
+	for _, child := range children {
+		if err := child.ModifyResponse(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetModifiers parses doc as a single modifier node and, on success, hot-swaps it
+// in as the chain applied in place of binary middleware when none is configured.
+func (d *DBClient) SetModifiers(doc []byte) error {
+	modifier, err := parseModifier(json.RawMessage(doc))
+	if err != nil {
+		return err
+	}
+
+	d.modifierMu.Lock()
+	d.modifier = modifier
+	d.modifierMu.Unlock()
+
+	log.Info("Modifier chain updated")
+	return nil
+}
+
+// Modifiers returns the currently configured modifier chain, or nil if none is set.
+func (d *DBClient) Modifiers() Modifier {
+	d.modifierMu.Lock()
+	defer d.modifierMu.Unlock()
+	return d.modifier
+}
+
+// ModifiersHandler handles `POST /modifiers`, replacing the in-process modifier
+// chain with the one described by the request body. It is wired up alongside the
+// other routes in startAdminInterface.
+func (d *DBClient) ModifiersHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Failed to read modifiers request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := d.SetModifiers(body); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Failed to parse modifiers document")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// cloneHeader returns a deep copy of h, so mutating the copy never bleeds
+// into the original request or response it was cloned from.
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		vv := make([]string, len(v))
+		copy(vv, v)
+		clone[k] = vv
+	}
+	return clone
+}
+
+// scrubRequestBody runs the configured modifier chain's ModifyRequest against
+// a throwaway copy of body - with its own header map, so resizing the body
+// can't touch req's real Content-Length - and returns the result. This is how
+// captureRequest gets a modifier, e.g. a body.Replace redacting a secret, to
+// scrub what ends up in the cache without altering what is actually forwarded
+// to the real destination. Returns body unchanged if no modifier chain is
+// configured or it errors on the shadow request.
+func (d *DBClient) scrubRequestBody(req *http.Request, body []byte) []byte {
+	modifier := d.Modifiers()
+	if modifier == nil {
+		return body
+	}
+
+	shadow := *req
+	shadow.Header = cloneHeader(req.Header)
+	shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := modifier.ModifyRequest(&shadow); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Modifier chain rejected request body during capture; storing it unscrubbed")
+		return body
+	}
+
+	scrubbed, err := ioutil.ReadAll(shadow.Body)
+	shadow.Body.Close()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Failed to read scrubbed request body; storing it unscrubbed")
+		return body
+	}
+	return scrubbed
+}
+
+// applyModifiersToRequest runs the configured modifier chain against req, a no-op if none
+// is set.
+func (d *DBClient) applyModifiersToRequest(req *http.Request) error {
+	modifier := d.Modifiers()
+	if modifier == nil {
+		return nil
+	}
+	return modifier.ModifyRequest(req)
+}
+
+// applyModifiersToResponse runs the configured modifier chain against resp, a
+// no-op if none is set.
+func (d *DBClient) applyModifiersToResponse(resp *http.Response) error {
+	modifier := d.Modifiers()
+	if modifier == nil || resp == nil {
+		return nil
+	}
+	return modifier.ModifyResponse(resp)
+}
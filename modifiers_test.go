@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestParseModifierDispatchesByType(t *testing.T) {
+	m, err := parseModifier(json.RawMessage(`{"status.Modifier": {"code": 503}}`))
+	if err != nil {
+		t.Fatalf("parseModifier returned error: %v", err)
+	}
+	if _, ok := m.(*statusModifier); !ok {
+		t.Fatalf("expected a *statusModifier, got %T", m)
+	}
+}
+
+func TestParseModifierUnknownType(t *testing.T) {
+	if _, err := parseModifier(json.RawMessage(`{"no.Such.Modifier": {}}`)); err == nil {
+		t.Fatalf("expected an error for an unregistered modifier type")
+	}
+}
+
+func TestParseModifierRejectsMultiKeyNode(t *testing.T) {
+	if _, err := parseModifier(json.RawMessage(`{"status.Modifier": {}, "header.Modifier": {}}`)); err == nil {
+		t.Fatalf("expected an error for a node with more than one key")
+	}
+}
+
+func TestBodyReplaceModifierModifiesRequestBody(t *testing.T) {
+	m, err := newBodyReplaceModifier(json.RawMessage(`{"pattern": "secret-[0-9]+", "replacement": "REDACTED"}`))
+	if err != nil {
+		t.Fatalf("newBodyReplaceModifier returned error: %v", err)
+	}
+
+	req := &http.Request{Header: http.Header{}}
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"token":"secret-123"}`)))
+
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest returned error: %v", err)
+	}
+
+	got, _ := ioutil.ReadAll(req.Body)
+	if !bytes.Contains(got, []byte("REDACTED")) || bytes.Contains(got, []byte("secret-123")) {
+		t.Fatalf("expected the secret to be redacted, got %q", got)
+	}
+}
+
+func TestFilterModifierDecidesPerRequestNotPerInstance(t *testing.T) {
+	m, err := newFilterModifier(json.RawMessage(`{
+		"match": {"host": "^match\\.example\\.com$"},
+		"child_on_match": [{"header.Modifier": {"name": "X-Branch", "value": "match"}}],
+		"child_on_no_match": [{"header.Modifier": {"name": "X-Branch", "value": "no-match"}}]
+	}`))
+	if err != nil {
+		t.Fatalf("newFilterModifier returned error: %v", err)
+	}
+
+	matchReq := &http.Request{Host: "match.example.com", Header: http.Header{}}
+	noMatchReq := &http.Request{Host: "other.example.com", Header: http.Header{}}
+
+	// Simulate two requests interleaving through the shared modifier: the
+	// no-match request's ModifyRequest runs between the match request's
+	// ModifyRequest and ModifyResponse. With match cached on the instance,
+	// this would flip the match request's response-side branch.
+	if err := m.ModifyRequest(matchReq); err != nil {
+		t.Fatalf("ModifyRequest(matchReq) returned error: %v", err)
+	}
+	if err := m.ModifyRequest(noMatchReq); err != nil {
+		t.Fatalf("ModifyRequest(noMatchReq) returned error: %v", err)
+	}
+
+	matchResp := &http.Response{Header: http.Header{}, Request: matchReq}
+	noMatchResp := &http.Response{Header: http.Header{}, Request: noMatchReq}
+
+	if err := m.ModifyResponse(matchResp); err != nil {
+		t.Fatalf("ModifyResponse(matchResp) returned error: %v", err)
+	}
+	if err := m.ModifyResponse(noMatchResp); err != nil {
+		t.Fatalf("ModifyResponse(noMatchResp) returned error: %v", err)
+	}
+
+	if got := matchResp.Header.Get("X-Branch"); got != "match" {
+		t.Fatalf("expected the matching request's response to take the match branch, got %q", got)
+	}
+	if got := noMatchResp.Header.Get("X-Branch"); got != "no-match" {
+		t.Fatalf("expected the non-matching request's response to take the no-match branch, got %q", got)
+	}
+}
+
+func TestScrubRequestBodyLeavesForwardedBodyUntouched(t *testing.T) {
+	d := &DBClient{}
+	m, err := newBodyReplaceModifier(json.RawMessage(`{"pattern": "secret-[0-9]+", "replacement": "REDACTED"}`))
+	if err != nil {
+		t.Fatalf("newBodyReplaceModifier returned error: %v", err)
+	}
+	d.modifier = m
+
+	rawBody := []byte(`{"token":"secret-123"}`)
+	req := &http.Request{Header: http.Header{}}
+	req.Body = ioutil.NopCloser(bytes.NewReader(rawBody))
+
+	scrubbed := d.scrubRequestBody(req, rawBody)
+	if !bytes.Contains(scrubbed, []byte("REDACTED")) {
+		t.Fatalf("expected the copy passed to storeBody to be scrubbed, got %q", scrubbed)
+	}
+	if !bytes.Equal(rawBody, []byte(`{"token":"secret-123"}`)) {
+		t.Fatalf("expected scrubRequestBody not to mutate its input, got %q", rawBody)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/elazarl/goproxy"
+	"gopkg.in/yaml.v2"
+)
+
+// Supported values for RoutingRule.ConnectAction.
+const (
+	ConnectActionMitm        = "mitm"
+	ConnectActionReject      = "reject"
+	ConnectActionHijack      = "hijack"
+	ConnectActionPassthrough = "passthrough"
+)
+
+// RoutingRule describes how requests to a matching host should be handled,
+// letting a single Hoverfly instance treat different hosts differently instead
+// of applying a single destination regex, mode and endpoint to everything.
+type RoutingRule struct {
+	HostPattern   string `json:"host_pattern" yaml:"host_pattern"`
+	ConnectAction string `json:"connect_action" yaml:"connect_action"`
+	ModeOverride  string `json:"mode_override,omitempty" yaml:"mode_override,omitempty"`
+	Endpoint      string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// compile lazily compiles HostPattern, caching the result on the rule.
+func (r *RoutingRule) compile() (*regexp.Regexp, error) {
+	if r.re == nil {
+		re, err := regexp.Compile(r.HostPattern)
+		if err != nil {
+			return nil, err
+		}
+		r.re = re
+	}
+	return r.re, nil
+}
+
+// matches reports whether host satisfies r.HostPattern.
+func (r *RoutingRule) matches(host string) bool {
+	re, err := r.compile()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":       err.Error(),
+			"hostPattern": r.HostPattern,
+		}).Error("Invalid routing rule host pattern")
+		return false
+	}
+	return re.MatchString(host)
+}
+
+// RoutingRules is an ordered list of RoutingRule, matched first-to-last so that
+// more specific rules can be placed ahead of general ones.
+type RoutingRules []RoutingRule
+
+// Match returns the first rule whose HostPattern matches host, or nil if none do.
+func (rules RoutingRules) Match(host string) *RoutingRule {
+	for i := range rules {
+		if rules[i].matches(host) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// LoadRoutingRules reads a RoutingRules list from a YAML or JSON file at path,
+// the format chosen by its extension (".yaml"/".yml" for YAML, anything else
+// as JSON), so rules can be provisioned from a file instead of only being
+// built into the binary via -destination.
+func LoadRoutingRules(path string) (RoutingRules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules RoutingRules
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &rules)
+	default:
+		err = json.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// rulesState holds the live routing rule list, hot-swappable through
+// RulesHandler the same way upstreamProxyState and the modifier chain are.
+// Only the per-request mode/endpoint overrides consulted in processRequest
+// pick up a change immediately - the CONNECT action handlers registered by
+// registerRoutingRules are wired onto the proxy once at startup, since
+// goproxy has no way to unregister or replace them afterwards.
+type rulesState struct {
+	mu    sync.Mutex
+	rules RoutingRules
+}
+
+// newRulesState returns a rulesState seeded with rules.
+func newRulesState(rules RoutingRules) *rulesState {
+	return &rulesState{rules: rules}
+}
+
+func (s *rulesState) get() RoutingRules {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rules
+}
+
+func (s *rulesState) set(rules RoutingRules) {
+	s.mu.Lock()
+	s.rules = rules
+	s.mu.Unlock()
+}
+
+// RulesHandler handles `GET /rules` and `POST /rules`: GET returns the live
+// routing rules as JSON, POST replaces them. See rulesState's doc comment for
+// what a POST can and can't change at runtime.
+func (d *DBClient) RulesHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		bts, err := json.Marshal(d.rules.get())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("Failed to serialize routing rules")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(bts)
+
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var rules RoutingRules
+		if err := json.Unmarshal(body, &rules); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		d.rules.set(rules)
+		log.Info("Routing rules updated")
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// registerRoutingRules wires one OnRequest handler per rule onto proxy, so that
+// different hosts can be mitm'd, rejected, hijacked or passed through side by
+// side instead of sharing a single destination regex and CONNECT action.
+func registerRoutingRules(proxy *goproxy.ProxyHttpServer, d *DBClient, rules RoutingRules) {
+	for i := range rules {
+		rule := rules[i]
+		matcher := goproxy.ReqHostMatches(regexp.MustCompile(rule.HostPattern))
+
+		switch rule.ConnectAction {
+		case ConnectActionReject:
+			proxy.OnRequest(matcher).HandleConnect(goproxy.AlwaysReject)
+		case ConnectActionHijack:
+			proxy.OnRequest(matcher).HijackConnect(func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+				hijackConnect(d, req, client, ctx)
+			})
+		case ConnectActionPassthrough:
+			// accept the CONNECT as a plain tunnel; an explicit handler keeps a
+			// later rule that also matches the host from taking over
+			proxy.OnRequest(matcher).HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+				return goproxy.OkConnect, host
+			})
+		default:
+			proxy.OnRequest(matcher).HandleConnect(goproxy.AlwaysMitm)
+		}
+	}
+}
+
+// hijackConnect services a hijacked CONNECT tunnel by relaying HTTP requests and
+// responses between the client and the remote host until either side closes,
+// dialing through d's configured upstream proxy when one is set.
+func hijackConnect(d *DBClient, req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	defer func() {
+		log.Warn("Inside defer")
+		if e := recover(); e != nil {
+			ctx.Logf("error connecting to remote: %v", e)
+			client.Write([]byte("HTTP/1.1 500 Cannot reach destination\r\n\r\n"))
+		}
+		client.Close()
+	}()
+
+	log.Warn("Hijacking connection")
+	clientBuf := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	remote, err := dialViaUpstream(d.upstreamProxy, req.URL.Host)
+	orPanic(err)
+	remoteBuf := bufio.NewReadWriter(bufio.NewReader(remote), bufio.NewWriter(remote))
+	for {
+		req, err := http.ReadRequest(clientBuf.Reader)
+		orPanic(err)
+		orPanic(req.Write(remoteBuf))
+		orPanic(remoteBuf.Flush())
+		resp, err := http.ReadResponse(remoteBuf.Reader, req)
+
+		orPanic(err)
+		orPanic(resp.Write(clientBuf.Writer))
+		orPanic(clientBuf.Flush())
+	}
+}
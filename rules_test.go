@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoutingRulesMatchFirstWins(t *testing.T) {
+	rules := RoutingRules{
+		{HostPattern: "^api\\.example\\.com$", Endpoint: "specific"},
+		{HostPattern: ".*", Endpoint: "catch-all"},
+	}
+
+	rule := rules.Match("api.example.com")
+	if rule == nil || rule.Endpoint != "specific" {
+		t.Fatalf("expected the more specific rule to win, got %+v", rule)
+	}
+
+	rule = rules.Match("other.example.com")
+	if rule == nil || rule.Endpoint != "catch-all" {
+		t.Fatalf("expected the catch-all rule to match, got %+v", rule)
+	}
+}
+
+func TestRoutingRulesMatchNone(t *testing.T) {
+	rules := RoutingRules{{HostPattern: "^api\\.example\\.com$"}}
+	if rule := rules.Match("unrelated.com"); rule != nil {
+		t.Fatalf("expected no match, got %+v", rule)
+	}
+}
+
+func TestLoadRoutingRulesJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hoverfly-rules-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "rules.json")
+	content := `[{"host_pattern": "^api\\.example\\.com$", "connect_action": "mitm", "mode_override": "capture"}]`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write rules file: %v", err)
+	}
+
+	rules, err := LoadRoutingRules(path)
+	if err != nil {
+		t.Fatalf("LoadRoutingRules returned error: %v", err)
+	}
+	if len(rules) != 1 || rules[0].ModeOverride != CaptureMode {
+		t.Fatalf("expected one capture-mode rule, got %+v", rules)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// UpstreamProxyConfig describes an HTTP(S) proxy that outbound requests should
+// be forwarded through, for deployments sitting behind a corporate egress
+// proxy. An empty URL means "no upstream proxy configured".
+//
+// Only HTTP Basic auth is supported. NTLM was considered but deliberately
+// left out of this iteration - it needs a stateful multi-round handshake
+// rather than a single header, which doesn't fit this struct or
+// authHeader's one-shot model - and would be its own follow-up if a
+// deployment actually needs it.
+type UpstreamProxyConfig struct {
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// proxyURL parses URL, returning nil when none is configured.
+func (u UpstreamProxyConfig) proxyURL() (*url.URL, error) {
+	if u.URL == "" {
+		return nil, nil
+	}
+	return url.Parse(u.URL)
+}
+
+// authHeader returns the Proxy-Authorization header value for basic auth, or
+// "" if no credentials are configured.
+func (u UpstreamProxyConfig) authHeader() string {
+	if u.Username == "" && u.Password == "" {
+		return ""
+	}
+	creds := base64.StdEncoding.EncodeToString([]byte(u.Username + ":" + u.Password))
+	return "Basic " + creds
+}
+
+// upstreamProxyState holds the live, hot-swappable upstream proxy
+// configuration, following the same pattern as the modifier chain.
+type upstreamProxyState struct {
+	mu  sync.Mutex
+	cfg UpstreamProxyConfig
+}
+
+func (s *upstreamProxyState) get() UpstreamProxyConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+func (s *upstreamProxyState) set(cfg UpstreamProxyConfig) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+}
+
+// newUpstreamTransport builds an http.Transport whose Proxy func returns
+// state's configured upstream proxy, falling back to
+// http.ProxyFromEnvironment when none is set.
+func newUpstreamTransport(state *upstreamProxyState) *http.Transport {
+	return &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			u, err := state.get().proxyURL()
+			if err != nil {
+				return nil, err
+			}
+			if u != nil {
+				return u, nil
+			}
+			return http.ProxyFromEnvironment(req)
+		},
+	}
+}
+
+// dialViaUpstream dials hostport, tunneling through state's configured
+// upstream proxy with an HTTP CONNECT when one is set, or dialing hostport
+// directly otherwise.
+func dialViaUpstream(state *upstreamProxyState, hostport string) (net.Conn, error) {
+	cfg := state.get()
+	proxyURL, err := cfg.proxyURL()
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return net.Dial("tcp", hostport)
+	}
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: hostport},
+		Host:   hostport,
+		Header: make(http.Header),
+	}
+	if auth := cfg.authHeader(); auth != "" {
+		connectReq.Header.Set("Proxy-Authorization", auth)
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy CONNECT to %s failed: %s", hostport, resp.Status)
+	}
+
+	return conn, nil
+}
+
+// splitProxyAuth splits a "user:password" string as accepted by the
+// -upstream-proxy-auth flag into its two parts.
+func splitProxyAuth(auth string) (username, password string) {
+	parts := strings.SplitN(auth, ":", 2)
+	if len(parts) != 2 {
+		return auth, ""
+	}
+	return parts[0], parts[1]
+}
+
+// UpstreamProxyHandler handles `POST /upstream-proxy`, hot-swapping the
+// upstream proxy configuration without a restart.
+func (d *DBClient) UpstreamProxyHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var cfg UpstreamProxyConfig
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	d.upstreamProxy.set(cfg)
+	log.Info("Upstream proxy configuration updated")
+	w.WriteHeader(http.StatusOK)
+}
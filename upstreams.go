@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Supported UpstreamPoolConfig.Policy values.
+const (
+	PolicyRoundRobin = "round_robin"
+	PolicyRandom     = "random"
+	PolicyLeastConn  = "least_conn"
+	PolicyIPHash     = "ip_hash"
+)
+
+// Upstream is a single backend in an UpstreamPool.
+type Upstream struct {
+	Address string `json:"address" yaml:"address"`
+	// HealthCheckPath, when set, is periodically GETed to actively probe this
+	// upstream instead of relying solely on passive failure counting.
+	HealthCheckPath string `json:"health_check_path,omitempty" yaml:"health_check_path,omitempty"`
+
+	mu             sync.Mutex
+	consecFailures int
+	downUntil      time.Time
+	drained        bool
+	activeConns    int64
+}
+
+// healthy reports whether u should currently be considered for selection.
+func (u *Upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.drained && time.Now().After(u.downUntil)
+}
+
+// recordResult feeds a passive health observation into u, marking it down for
+// cooldown once it has failed maxFailures times in a row.
+func (u *Upstream) recordResult(failed bool, maxFailures int, cooldown time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !failed {
+		u.consecFailures = 0
+		return
+	}
+	u.consecFailures++
+	if u.consecFailures >= maxFailures {
+		u.downUntil = time.Now().Add(cooldown)
+	}
+}
+
+// setDrained marks u as deliberately excluded from selection, independent of
+// its passive/active health state.
+func (u *Upstream) setDrained(drained bool) {
+	u.mu.Lock()
+	u.drained = drained
+	u.mu.Unlock()
+}
+
+// Acquire/Release track in-flight requests for the least_conn policy.
+func (u *Upstream) Acquire() { atomic.AddInt64(&u.activeConns, 1) }
+func (u *Upstream) Release() { atomic.AddInt64(&u.activeConns, -1) }
+
+// Health summarises an Upstream's current state for the admin API.
+type Health struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	Drained bool   `json:"drained"`
+}
+
+// UpstreamPoolConfig configures an UpstreamPool's selection policy and passive
+// (and optionally active) health checking.
+type UpstreamPoolConfig struct {
+	Policy           string        `json:"policy" yaml:"policy"`
+	MaxFailures      int           `json:"max_failures" yaml:"max_failures"`
+	Cooldown         time.Duration `json:"cooldown" yaml:"cooldown"`
+	ActiveCheckEvery time.Duration `json:"active_check_every,omitempty" yaml:"active_check_every,omitempty"`
+}
+
+// UpstreamPool selects a healthy Upstream per request according to its
+// configured policy, replacing a single static cfg.endpoint with a
+// load-balanced pool.
+type UpstreamPool struct {
+	Config    UpstreamPoolConfig
+	upstreams []*Upstream
+
+	mu   sync.Mutex
+	next uint64
+}
+
+// NewUpstreamPool builds a pool over addrs and, if an active check interval is
+// configured, starts its background health-check loop.
+func NewUpstreamPool(cfg UpstreamPoolConfig, addrs []Upstream) *UpstreamPool {
+	upstreams := make([]*Upstream, len(addrs))
+	for i := range addrs {
+		u := addrs[i]
+		upstreams[i] = &u
+	}
+
+	pool := &UpstreamPool{Config: cfg, upstreams: upstreams}
+	if cfg.ActiveCheckEvery > 0 {
+		go pool.runActiveChecks()
+	}
+	return pool
+}
+
+// runActiveChecks periodically GETs each upstream's HealthCheckPath, feeding
+// the result into the same passive failure counter used by doRequest.
+func (p *UpstreamPool) runActiveChecks() {
+	for range time.Tick(p.Config.ActiveCheckEvery) {
+		for _, u := range p.upstreams {
+			if u.HealthCheckPath == "" {
+				continue
+			}
+			resp, err := http.Get("http://" + u.Address + u.HealthCheckPath)
+			failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+			if resp != nil {
+				resp.Body.Close()
+			}
+			u.recordResult(failed, p.Config.MaxFailures, p.Config.Cooldown)
+		}
+	}
+}
+
+// Next returns the next healthy upstream to use for req according to the
+// pool's policy, or false if every upstream is down or drained.
+func (p *UpstreamPool) Next(req *http.Request) (*Upstream, bool) {
+	healthy := make([]*Upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.healthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, false
+	}
+
+	switch p.Config.Policy {
+	case PolicyRandom:
+		return healthy[rand.Intn(len(healthy))], true
+
+	case PolicyLeastConn:
+		best := healthy[0]
+		for _, u := range healthy[1:] {
+			if atomic.LoadInt64(&u.activeConns) < atomic.LoadInt64(&best.activeConns) {
+				best = u
+			}
+		}
+		return best, true
+
+	case PolicyIPHash:
+		h := fnv.New32a()
+		h.Write([]byte(req.RemoteAddr))
+		return healthy[int(h.Sum32())%len(healthy)], true
+
+	default: // PolicyRoundRobin
+		p.mu.Lock()
+		idx := p.next % uint64(len(healthy))
+		p.next++
+		p.mu.Unlock()
+		return healthy[idx], true
+	}
+}
+
+// RecordResult feeds a passive health observation for upstream addr into the
+// pool, if addr belongs to it.
+func (p *UpstreamPool) RecordResult(addr string, failed bool) {
+	for _, u := range p.upstreams {
+		if u.Address == addr {
+			u.recordResult(failed, p.Config.MaxFailures, p.Config.Cooldown)
+			return
+		}
+	}
+}
+
+// Health reports the current health of every upstream in the pool.
+func (p *UpstreamPool) Health() []Health {
+	health := make([]Health, len(p.upstreams))
+	for i, u := range p.upstreams {
+		health[i] = Health{Address: u.Address, Healthy: u.healthy(), Drained: u.drained}
+	}
+	return health
+}
+
+// Drain marks addr as drained (excluded from selection) or undrains it.
+func (p *UpstreamPool) Drain(addr string, drained bool) bool {
+	for _, u := range p.upstreams {
+		if u.Address == addr {
+			u.setDrained(drained)
+			return true
+		}
+	}
+	return false
+}
+
+// UpstreamsHealthHandler handles `GET /upstreams`, listing every upstream's
+// health so it can be watched without restarting the proxy.
+func (d *DBClient) UpstreamsHealthHandler(w http.ResponseWriter, req *http.Request) {
+	if d.pool == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+		return
+	}
+
+	bts, err := json.Marshal(d.pool.Health())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Failed to serialize upstream health")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(bts)
+}
+
+// UpstreamsDrainHandler handles `POST /upstreams/drain`, draining (or
+// undraining) a single upstream by address without a restart.
+func (d *DBClient) UpstreamsDrainHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if d.pool == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Address string `json:"address"`
+		Drained bool   `json:"drained"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !d.pool.Drain(body.Address, body.Drained) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUpstreamPoolNextRoundRobin(t *testing.T) {
+	pool := NewUpstreamPool(UpstreamPoolConfig{Policy: PolicyRoundRobin}, []Upstream{
+		{Address: "a"},
+		{Address: "b"},
+	})
+
+	req := &http.Request{}
+	first, ok := pool.Next(req)
+	if !ok {
+		t.Fatalf("expected a healthy upstream")
+	}
+	second, ok := pool.Next(req)
+	if !ok {
+		t.Fatalf("expected a healthy upstream")
+	}
+	if first.Address == second.Address {
+		t.Fatalf("expected round_robin to alternate upstreams, got %q twice", first.Address)
+	}
+}
+
+func TestUpstreamPoolNextSkipsDrained(t *testing.T) {
+	pool := NewUpstreamPool(UpstreamPoolConfig{Policy: PolicyRoundRobin}, []Upstream{
+		{Address: "a"},
+		{Address: "b"},
+	})
+	if !pool.Drain("a", true) {
+		t.Fatalf("expected Drain to find upstream %q", "a")
+	}
+
+	for i := 0; i < 3; i++ {
+		u, ok := pool.Next(&http.Request{})
+		if !ok {
+			t.Fatalf("expected a healthy upstream")
+		}
+		if u.Address == "a" {
+			t.Fatalf("expected drained upstream %q to never be selected", "a")
+		}
+	}
+}
+
+func TestUpstreamPoolNextNoneHealthy(t *testing.T) {
+	pool := NewUpstreamPool(UpstreamPoolConfig{Policy: PolicyRoundRobin}, []Upstream{{Address: "a"}})
+	pool.Drain("a", true)
+
+	if _, ok := pool.Next(&http.Request{}); ok {
+		t.Fatalf("expected no healthy upstream once the only one is drained")
+	}
+}